@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Principal is the caller identity asserted by Fabric CA at enrollment,
+// abstracted behind an interface so access decisions never compare raw
+// certificate bytes.
+type Principal interface {
+	MSPID() (string, error)
+	CN() (string, error)
+	GetAttribute(name string) (string, bool, error)
+}
+
+// cidPrincipal resolves a Principal from the transaction proposal via the
+// chaincode cid library.
+type cidPrincipal struct {
+	stub shim.ChaincodeStubInterface
+}
+
+// resolvePrincipal builds the Principal for the current invocation's caller.
+func resolvePrincipal(stub shim.ChaincodeStubInterface) Principal {
+	return &cidPrincipal{stub: stub}
+}
+
+func (p *cidPrincipal) MSPID() (string, error) {
+	return cid.GetMSPID(p.stub)
+}
+
+func (p *cidPrincipal) CN() (string, error) {
+	cert, err := cid.GetX509Certificate(p.stub)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
+
+func (p *cidPrincipal) GetAttribute(name string) (string, bool, error) {
+	return cid.GetAttributeValue(p.stub, name)
+}
+
+// DoctorPolicy is the ABAC policy recorded when a doctor is registered, from
+// the attributes Fabric CA asserted on the registering caller's certificate.
+// checkAccess compares only CN and role against a later caller; Specialty and
+// Hospital are recorded but not compared.
+type DoctorPolicy struct {
+	Doctor    string `json:"doctor"`
+	CN        string `json:"cn"`
+	Role      string `json:"role"`
+	Specialty string `json:"specialty,omitempty"`
+	Hospital  string `json:"hospital,omitempty"`
+}
+
+// matchesCaller reports whether the resolved principal satisfies this
+// doctor's policy: the right CN, with a role=doctor attribute asserted by
+// Fabric CA.
+func (policy DoctorPolicy) matchesCaller(principal Principal) (bool, error) {
+	cn, err := principal.CN()
+	if err != nil {
+		return false, err
+	}
+	if cn != policy.CN {
+		return false, nil
+	}
+
+	role, ok, err := principal.GetAttribute("role")
+	if err != nil {
+		return false, err
+	}
+	if !ok || role != "doctor" {
+		return false, errors.New("Caller certificate is missing a role=doctor attribute")
+	}
+
+	return true, nil
+}
+
+// verifyDoctor checks that the caller is the enrolled doctor registered
+// under name, using the same ABAC policy as checkAccess. It is used by
+// flows that need to confirm a caller's doctor identity without also
+// checking patient-level access, such as prescription issuance.
+func verifyDoctor(stub shim.ChaincodeStubInterface, doctor string) error {
+	key, err := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
+	if err != nil {
+		return err
+	}
+
+	data, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return errors.New("Doctor not registered")
+	}
+
+	var policy DoctorPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+
+	matches, err := policy.matchesCaller(resolvePrincipal(stub))
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return errors.New("Caller is not the named doctor")
+	}
+	return nil
+}
+
+// verifyPharmacist checks that the caller's certificate carries a
+// role=pharmacist attribute. Pharmacists aren't pre-registered the way
+// doctors are; Fabric CA's attestation is trusted directly.
+func verifyPharmacist(stub shim.ChaincodeStubInterface) error {
+	role, ok, err := resolvePrincipal(stub).GetAttribute("role")
+	if err != nil {
+		return err
+	}
+	if !ok || role != "pharmacist" {
+		return errors.New("Caller certificate is missing a role=pharmacist attribute")
+	}
+	return nil
+}
@@ -1,97 +1,335 @@
-package main
-
-import (
-	"crypto/x509"
-	"encoding/binary"
-	"encoding/json"
-	"encoding/pem"
-	"errors"
-	"fmt"
-
-	"github.com/golang/protobuf/proto"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/protos/msp"
-	"github.com/hyperledger/fabric/protos/peer"
-)
-
-const (
-	// DoctorPublicKey database key prefix for doctor keys
-	DoctorPublicKey = "__access_public_key_"
-	// DoctorAccessKey database key prefix for doctor access
-	DoctorAccessKey = "__access_doctor_"
-)
-
-// MedicalRecordChaincode is the object that contains all of the chaincode that can be executed
-type AccessControl struct {
-	record *MedicalRecordChaincode
-}
-
-type AccessType int
-
-const (
-	None AccessType = 0
-	Info AccessType= 1
-	Full AccessType= 2
-)
-
-// registerDoctor adds doctor key to database
-func (t *AccessControl) registerDoctor(stub shim.ChaincodeStubInterface, doctor string, doctorKey byte[]) bool, error
-{
-	key, _ := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
-	data, err := stub.GetState(stub, key)
-
-	if err != nil {
-		return false, err
-	}
-
-	if data != nil {
-		return false, error("Already registered")
-	}
-
-	stub.PutState(key, doctorKey)
-
-	return true, nil
-}
-
-// setAccess sets doctor access level, returns true if access was changed
-func (t *AccessControl) setAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, accType AccessType) bool, error
-{
-	accesskey, _ := stub.CreateCompositeKey(DoctorAccessKey, []string{doctor, fmt.Sprint(patientId)})
-	current, err := t.record.getValue(stub, accesskey)
-
-	if (err != nil || current == accType) {
-		return false, err
-	}
-
-	t.record.setValue(stub, accesskey, accType)
-
-	return true, nil
-}
-
-// checkAccess returns doctor access level
-func (t *AccessControl) checkAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, caller byte[]) AccessType, error
-{
-	key, _ := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
-	data, err := stub.GetState(stub, key)
-
-	if err != nil {
-		return 0, err
-	}
-
-	if data == nil {
-		return 0, error("Doctor not registered")
-	}
-
-	if data != caller {
-		return 0, error("Invalid caller certificate")
-	}
-
-	accesskey, _ := stub.CreateCompositeKey(MetadataKey, []string{"doctor", fmt.Sprint(patientId)})
-	current, err := t.record.getValue(stub, accesskey)
-
-	if err != nil {
-		return 0, err
-	}
-
-	return current, nil
-}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	// DoctorPublicKey database key prefix for registered doctors' ABAC policies
+	DoctorPublicKey = "__access_public_key_"
+	// DoctorAccessKey database key prefix for doctor access
+	DoctorAccessKey = "__access_doctor_"
+	// AccessGrantKey database key prefix for patient-approved access grants
+	AccessGrantKey = "__access_grant_"
+	// AccessRequestKey database key prefix for pending doctor access requests
+	AccessRequestKey = "__access_request_"
+	// PatientCNKey database key prefix for the enrolled CN that owns a patient record
+	PatientCNKey = "__patient_cn_"
+)
+
+// AccessControl holds the doctor registration, access grant and patient
+// consent logic used by MedicalRecordChaincode
+type AccessControl struct {
+	record *MedicalRecordChaincode
+}
+
+type AccessType int
+
+const (
+	None AccessType = 0
+	Info AccessType = 1
+	Full AccessType = 2
+)
+
+// AccessGrant records the access level a patient (or, as a fallback, the
+// chaincode owner) has approved for a doctor, and when that approval expires.
+type AccessGrant struct {
+	Access    AccessType `json:"access"`
+	ExpiresAt int64      `json:"expiresAt"`
+	GrantedBy string     `json:"grantedBy"`
+}
+
+// AccessRequest is a doctor's outstanding ask for access to a patient. It stays
+// pending until the patient approves it with grantAccess; there is no
+// operation that denies a request, and the owner's setAccess leaves it pending.
+type AccessRequest struct {
+	PatientID   uint64     `json:"patient"`
+	Doctor      string     `json:"doctor"`
+	Access      AccessType `json:"access"`
+	RequestedAt int64      `json:"requestedAt"`
+}
+
+// registerDoctor stores an ABAC policy for a doctor, resolved from the
+// caller's own enrolled X.509 attributes, instead of pinning their raw
+// certificate bytes (which broke the moment a doctor re-enrolled).
+func (t *AccessControl) registerDoctor(stub shim.ChaincodeStubInterface, doctor string) (bool, error) {
+	key, err := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
+	if err != nil {
+		return false, err
+	}
+
+	data, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	if data != nil {
+		return false, errors.New("Already registered")
+	}
+
+	principal := resolvePrincipal(stub)
+	cn, err := principal.CN()
+	if err != nil {
+		return false, err
+	}
+
+	role, ok, err := principal.GetAttribute("role")
+	if err != nil {
+		return false, err
+	}
+	if !ok || role != "doctor" {
+		return false, errors.New("Caller certificate is missing a role=doctor attribute")
+	}
+
+	specialty, _, err := principal.GetAttribute("specialty")
+	if err != nil {
+		return false, err
+	}
+	hospital, _, err := principal.GetAttribute("hospital")
+	if err != nil {
+		return false, err
+	}
+
+	policy := DoctorPolicy{Doctor: doctor, CN: cn, Role: role, Specialty: specialty, Hospital: hospital}
+	result, err := json.Marshal(policy)
+	if err != nil {
+		return false, err
+	}
+
+	return true, stub.PutState(key, result)
+}
+
+// setAccess sets doctor access level directly, bypassing patient consent. This
+// is the fallback admin path for the owner; patients should use grantAccess.
+// Returns true if access was changed.
+func (t *AccessControl) setAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, accType AccessType) (bool, error) {
+	accesskey, _ := stub.CreateCompositeKey(AccessGrantKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	data, _ := stub.GetState(accesskey)
+
+	var current AccessGrant
+	if data != nil {
+		json.Unmarshal(data, &current)
+	}
+
+	if current.Access == accType {
+		return false, nil
+	}
+
+	grant := AccessGrant{Access: accType, ExpiresAt: 0, GrantedBy: "owner"}
+	result, _ := json.Marshal(grant)
+	stub.PutState(accesskey, result)
+
+	return true, nil
+}
+
+// checkAccess returns the doctor's access level for a patient. Identity is
+// asserted via X.509 attributes (see Principal) rather than a pinned
+// certificate, so a doctor keeps access across re-enrollment.
+func (t *AccessControl) checkAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string) (AccessType, error) {
+	key, err := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if data == nil {
+		return 0, errors.New("Doctor not registered")
+	}
+
+	var policy DoctorPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return 0, err
+	}
+
+	principal := resolvePrincipal(stub)
+	matches, err := policy.matchesCaller(principal)
+	if err != nil {
+		return 0, err
+	}
+	if !matches {
+		return 0, errors.New("Invalid caller certificate")
+	}
+
+	accesskey, _ := stub.CreateCompositeKey(AccessGrantKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	grantData, err := stub.GetState(accesskey)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if grantData == nil {
+		return None, nil
+	}
+
+	var grant AccessGrant
+	if err := json.Unmarshal(grantData, &grant); err != nil {
+		return 0, err
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+
+	if grant.ExpiresAt != 0 && grant.ExpiresAt < txTimestamp.Seconds {
+		return None, errors.New("Access grant has expired")
+	}
+
+	return grant.Access, nil
+}
+
+//**************************************************************
+// Patient consent workflow
+//**************************************************************
+
+// setPatientCN records the enrolled CN that owns a patient record, captured
+// at RegisterPatient time, so later grant/revoke calls can be gated to it.
+func (t *AccessControl) setPatientCN(stub shim.ChaincodeStubInterface, patientId uint64, cn string) error {
+	key, _ := stub.CreateCompositeKey(PatientCNKey, []string{strconv.FormatUint(patientId, 10)})
+	return stub.PutState(key, []byte(cn))
+}
+
+// getPatientCN returns the CN registered as the owner of a patient record.
+func (t *AccessControl) getPatientCN(stub shim.ChaincodeStubInterface, patientId uint64) (string, error) {
+	key, _ := stub.CreateCompositeKey(PatientCNKey, []string{strconv.FormatUint(patientId, 10)})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// isPatient returns whether caller is the enrolled CN that owns patientId.
+func (t *AccessControl) isPatient(stub shim.ChaincodeStubInterface, patientId uint64, caller string) (bool, error) {
+	cn, err := t.getPatientCN(stub, patientId)
+	if err != nil {
+		return false, err
+	}
+	return cn != "" && cn == caller, nil
+}
+
+// requestAccess lets a registered doctor ask a patient for access. The
+// request sits pending until the patient calls grantAccess or it is
+// superseded by a new request.
+func (t *AccessControl) requestAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, accType AccessType) (bool, error) {
+	doctorKey, _ := stub.CreateCompositeKey(DoctorPublicKey, []string{doctor})
+	doctorData, err := stub.GetState(doctorKey)
+	if err != nil {
+		return false, err
+	}
+	if doctorData == nil {
+		return false, errors.New("Doctor not registered")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return false, err
+	}
+
+	request := AccessRequest{
+		PatientID:   patientId,
+		Doctor:      doctor,
+		Access:      accType,
+		RequestedAt: txTimestamp.Seconds,
+	}
+	result, _ := json.Marshal(request)
+
+	requestKey, _ := stub.CreateCompositeKey(AccessRequestKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	return true, stub.PutState(requestKey, result)
+}
+
+// grantAccess lets the patient approve a doctor's access, with an optional
+// expiry timestamp. Only the patient's enrolled CN may call this.
+func (t *AccessControl) grantAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, accType AccessType, expiresAt int64, caller string) (bool, error) {
+	isPatient, err := t.isPatient(stub, patientId, caller)
+	if err != nil {
+		return false, err
+	}
+	if !isPatient {
+		return false, errors.New("Only the patient may grant access")
+	}
+
+	grant := AccessGrant{Access: accType, ExpiresAt: expiresAt, GrantedBy: caller}
+	result, _ := json.Marshal(grant)
+
+	accesskey, _ := stub.CreateCompositeKey(AccessGrantKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	if err := stub.PutState(accesskey, result); err != nil {
+		return false, err
+	}
+
+	requestKey, _ := stub.CreateCompositeKey(AccessRequestKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	return true, stub.DelState(requestKey)
+}
+
+// revokeAccess lets the patient (or, as a fallback, the owner) withdraw a
+// doctor's access immediately.
+func (t *AccessControl) revokeAccess(stub shim.ChaincodeStubInterface, patientId uint64, doctor string, caller string) (bool, error) {
+	isPatient, err := t.isPatient(stub, patientId, caller)
+	if err != nil {
+		return false, err
+	}
+
+	if !isPatient {
+		owner, err := getOwnerCN(stub)
+		if err != nil {
+			return false, err
+		}
+		if owner != caller {
+			return false, errors.New("Only the patient or the owner may revoke access")
+		}
+	}
+
+	grant := AccessGrant{Access: None, ExpiresAt: 0, GrantedBy: caller}
+	result, _ := json.Marshal(grant)
+
+	accesskey, _ := stub.CreateCompositeKey(AccessGrantKey, []string{strconv.FormatUint(patientId, 10), doctor})
+	return true, stub.PutState(accesskey, result)
+}
+
+// listPendingRequests returns the doctors currently waiting on a patient's
+// decision. Gated to the patient themselves or the owner.
+func (t *AccessControl) listPendingRequests(stub shim.ChaincodeStubInterface, patientId uint64, caller string) ([]AccessRequest, error) {
+	isPatient, err := t.isPatient(stub, patientId, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isPatient {
+		owner, err := getOwnerCN(stub)
+		if err != nil {
+			return nil, err
+		}
+		if owner != caller {
+			return nil, errors.New("Only the patient or the owner may list pending requests")
+		}
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(AccessRequestKey, []string{strconv.FormatUint(patientId, 10)})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	requests := []AccessRequest{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var request AccessRequest
+		if err := json.Unmarshal(item.Value, &request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	// AuditKey database key prefix for access-affecting audit entries
+	AuditKey = "__audit_"
+	// AuditEventName is the chaincode event emitted alongside every audit entry
+	AuditEventName = "AuditEntry"
+)
+
+// AuditEntry is a tamper-evident record of a single access-affecting call,
+// written to the ledger and mirrored as a chaincode event so off-chain
+// listeners can stream activity without polling the ledger.
+type AuditEntry struct {
+	PatientID uint64     `json:"patient"`
+	Function  string     `json:"function"`
+	Caller    string     `json:"caller"`
+	ArgsHash  string     `json:"argsHash"`
+	Access    AccessType `json:"access"`
+	Outcome   string     `json:"outcome"`
+	Timestamp int64      `json:"timestamp"`
+	TxID      string     `json:"txID"`
+}
+
+// GetAuditTrailParams selects the patient to audit and how to read the trail.
+type GetAuditTrailParams struct {
+	PatientID  uint64 `json:"patient"`
+	UseHistory bool   `json:"useHistory"`
+}
+
+// hashArgs fingerprints a raw invoke payload without persisting the
+// (possibly sensitive) payload itself on the ledger.
+func hashArgs(raw json.RawMessage) string {
+	h := sha256.New()
+	h.Write(raw)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordAudit appends an audit entry for an access-affecting call and emits a
+// matching chaincode event. patientId may be 0 for calls with no single
+// patient in scope (e.g. RegisterDoctor).
+func recordAudit(stub shim.ChaincodeStubInterface, patientId uint64, function string, caller string, raw json.RawMessage, access AccessType, outcome string) error {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	entry := AuditEntry{
+		PatientID: patientId,
+		Function:  function,
+		Caller:    caller,
+		ArgsHash:  hashArgs(raw),
+		Access:    access,
+		Outcome:   outcome,
+		Timestamp: txTimestamp.Seconds,
+		TxID:      stub.GetTxID(),
+	}
+	result, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key, err := stub.CreateCompositeKey(AuditKey, []string{strconv.FormatUint(patientId, 10), fmt.Sprint(txTimestamp.Seconds), stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+
+	if err := stub.PutState(key, result); err != nil {
+		return err
+	}
+
+	return stub.SetEvent(AuditEventName, result)
+}
+
+// getAuditTrail returns the audit entries recorded for a patient, gated to
+// the chaincode owner and to the patient themselves. When useHistory is set
+// it walks the patient record's ledger history instead of the audit log.
+func (t *MedicalRecordChaincode) getAuditTrail(stub shim.ChaincodeStubInterface, patientId uint64, caller string, useHistory bool) ([]AuditEntry, error) {
+	owner, err := getOwnerCN(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := AccessControl{t}
+	isPatient, err := ac.isPatient(stub, patientId, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner != caller && !isPatient {
+		return nil, errors.New("Caller may not read this patient's audit trail")
+	}
+
+	if useHistory {
+		return t.getAuditTrailFromHistory(stub, patientId)
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(AuditKey, []string{strconv.FormatUint(patientId, 10)})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	entries := []AuditEntry{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(item.Value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// getAuditTrailFromHistory reconstructs an approximate audit trail from the
+// patient record's own ledger history, for deployments that prefer not to
+// maintain a parallel audit index.
+func (t *MedicalRecordChaincode) getAuditTrailFromHistory(stub shim.ChaincodeStubInterface, patientId uint64) ([]AuditEntry, error) {
+	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{strconv.FormatUint(patientId, 10)})
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	entries := []AuditEntry{}
+	for iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, AuditEntry{
+			PatientID: patientId,
+			Function:  "UpdatePatientDetails",
+			ArgsHash:  hashArgs(mod.Value),
+			Outcome:   "committed",
+			Timestamp: mod.Timestamp.Seconds,
+			TxID:      mod.TxId,
+		})
+	}
+
+	return entries, nil
+}
@@ -1,469 +1,900 @@
-package main
-
-import (
-	"crypto/x509"
-	"encoding/binary"
-	"encoding/json"
-	"encoding/pem"
-	"errors"
-	"fmt"
-
-	"github.com/golang/protobuf/proto"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/protos/msp"
-	"github.com/hyperledger/fabric/protos/peer"
-)
-
-const (
-	// PatientInfoKey database key prefix for patient information
-	MetadataKey = "__metadata_"
-	// PatientInfoKey database key prefix for patient information
-	PatientInfoKey = "__patient_record_"
-	// PatientInfoCountKey database key prefix for patient count
-	PatientInfoCountKey = "__patient_count_"
-	// MedVisitKey database key prefix for medical visits
-	MedVisitKey = "__visit_record_"
-	// VisitInfoCountKey database key prefix for visit count
-	VisitInfoCountKey = "__visit_count_"
-)
-
-// main function starts up the chaincode in the container during instantiation
-func main() {
-	if err := shim.Start(new(MedicalRecordChaincode)); err != nil {
-		fmt.Printf("Error starting chaincode: %s", err)
-	}
-}
-
-// MedicalRecordChaincode is the object that contains all of the chaincode that can be executed
-type MedicalRecordChaincode struct {
-}
-
-//Delivery information about a single delivery
-type PatientInfo struct {
-	PatientID uint64 `json:"ID"`
-	FirstName string `json:"firstname"`
-	LastName  string `json:"lastname"`
-	Gender    uint64 `json:"gender"` // 0 - Unspecified; 1 - Male; 2 - Female;
-	BirthDate uint64 `json:"birthdate"`
-	Phone     string `json:"phone"`
-}
-
-type MedicalVisit struct {
-	VisitID      uint64 `json:"ID"`
-	PatientID    uint64 `json:"patient"`
-	Doctor       string `json:"doctor"`
-	Complaint    string `json:"complaint"`
-	Diagnosis    string `json:"diagnosis"`
-	Perscription string `json:"perscription"`
-}
-
-type PatientInfoParams struct {
-	FirstName string `json:"firstname"`
-	LastName  string `json:"lastname"`
-	Gender    uint64 `json:"gender"`
-	BirthDate uint64 `json:"birthdate"`
-	Phone     string `json:"phone"`
-}
-
-type PatientIDParams struct {
-	PatientID uint64 `json:"ID"`
-	Doctor    string `json:"doctor"`
-}
-
-type VisitInfoParams struct {
-	PatientID uint64 `json:"patient"`
-	Doctor    string `json:"doctor"`
-	Complaint string `json:"complaint"`
-}
-
-type DiagnosisParams struct {
-	VisitID   uint64 `json:"ID"`
-	PatientID uint64 `json:"patient"`
-	Diagnosis string `json:"diagnosis"`
-}
-
-type PerscriptionParams struct {
-	VisitID      uint64 `json:"ID"`
-	PatientID    uint64 `json:"patient"`
-	Perscription string `json:"perscription"`
-}
-
-type DoctorParams struct {
-	Doctor string `json:"doctor"`
-}
-
-type SetDoctorAccessParams struct {
-	PatientID uint64 `json:"patient"`
-	Doctor    string `json:"doctor"`
-	Access    uint64 `json:"access"`
-}
-
-type MedicalRecords struct {
-	Patient PatientInfo    `json:"patient"`
-	History []MedicalVisit `json:"history"`
-}
-
-// Init runs initialization for chaincode
-func (t *MedicalRecordChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
-	caller, err := callerCN(stub)
-	if err != nil {
-		return shim.Error("Error getting caller cn")
-	}
-
-	ownerKey, err := getOwnerKey(stub)
-	if err != nil {
-		return shim.Error("Error getting database key")
-	}
-
-	err = stub.PutState(ownerKey, []byte(caller))
-	if err != nil {
-		return shim.Error("Error saving data")
-	}
-
-	return shim.Success(nil)
-}
-
-// Invoke runs functions of chaincode
-func (t *MedicalRecordChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
-	fn, args := stub.GetFunctionAndParameters()
-	switch fn {
-	case "RegisterPatient":
-		return t.registerPatient(stub, args)
-	case "UpdatePatientDetails":
-		return t.updatePatient(stub, args)
-	case "GetPatient":
-		return t.getPatientById(stub, args)
-	case "PatientVisit":
-		return t.patientVisit(stub, args)
-	case "SetDiagnosis":
-		return t.setDiagnosis(stub, args)
-	case "SetPerscription":
-		return t.setPerscription(stub, args)
-	case "GetMedicalRecords":
-		return t.getMedicalRecords(stub, args)
-	case "RegisterDoctor":
-		return t.registerDoctor(stub, args)
-	case "SetDoctorAccess":
-		return t.setDocAccess(stub, args)
-	}
-	return shim.Error("Undefined function")
-}
-
-func (t *MedicalRecordChaincode) registerPatient(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := PatientInfoParams{}
-	_, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	count, _ := t.getValue(stub, PatientInfoCountKey)
-
-	var newPatient = PatientInfo{
-		PatientID: count + 1,
-		FirstName: params.FirstName,
-		LastName:  params.LastName,
-		Gender:    params.Gender,
-		BirthDate: params.BirthDate,
-		Phone:     params.Phone,
-	}
-	t.setPatient(stub, newPatient)
-	t.setValue(stub, PatientInfoCountKey, count+1)
-
-	result, _ := json.Marshal(newPatient)
-	return shim.Success(result)
-}
-
-func (t *MedicalRecordChaincode) setDocAccess(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := SetDoctorAccessParams{}
-	caller, _, err := getCallParams(stub, args, params)
-
-	ac := AccessControl{t}
-	_, err := ac.setAccess(stub, params.PatientId, params.Doctor, params.Access)
-
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	return shim.Success(nil)
-}
-
-func (t *MedicalRecordChaincode) registerDoctor(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := DoctorParams{}
-	caller, _, err := getCallParams(stub, args, params)
-
-	ac := AccessControl{t}
-	_, err := ac.registerDoctor(stub, params.Doctor, []byte(caller))
-
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	return shim.Success(nil)
-}
-
-func (t *MedicalRecordChaincode) updatePatient(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := PatientInfo{}
-	_, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	_, err = t.getPatient(stub, params.PatientID)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	t.setPatient(stub, params)
-	return shim.Success(nil)
-}
-
-func (t *MedicalRecordChaincode) getPatientById(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := PatientIDParams{}
-	caller, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	ac := AccessControl{t}
-	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor, []byte(caller))
-	if access == 0 {
-		return shim.Error("Caller does not have access to patient info.")
-	}
-
-	patient, err := t.getPatient(stub, params.PatientID)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	result, _ := json.Marshal(patient)
-	return shim.Success(result)
-}
-
-func (t *MedicalRecordChaincode) patientVisit(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := VisitInfoParams{}
-	_, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	countkey, _ := stub.CreateCompositeKey(VisitInfoCountKey, []string{string(params.PatientID)})
-	count, _ := t.getValue(stub, countkey)
-
-	var newVisit = MedicalVisit{
-		VisitID:   count + 1,
-		PatientID: params.PatientID,
-		Doctor:    params.Doctor,
-		Complaint: params.Complaint,
-	}
-	t.setVisit(stub, newVisit)
-	t.setValue(stub, countkey, count+1)
-
-	result, _ := json.Marshal(newVisit)
-	return shim.Success(result)
-}
-
-func (t *MedicalRecordChaincode) setDiagnosis(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := DiagnosisParams{}
-	caller, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	visit, _ := t.getVisit(stub, params.PatientID, params.VisitID)
-
-	ac := AccessControl{t}
-	access, _ := ac.checkAccess(stub, params.PatientID, visit.Doctor, []byte(caller))
-	if access != 2 {
-		return shim.Error("Caller does not have access to patient data.")
-	}
-
-	visit.Diagnosis = params.Diagnosis
-	t.setVisit(stub, visit)
-
-	result, _ := json.Marshal(visit)
-	return shim.Success(result)
-}
-
-func (t *MedicalRecordChaincode) setPerscription(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := PerscriptionParams{}
-	caller, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	visit, _ := t.getVisit(stub, params.PatientID, params.VisitID)
-
-	ac := AccessControl{t}
-	access, _ := ac.checkAccess(stub, params.PatientID, visit.Doctor, []byte(caller))
-	if access != 2 {
-		return shim.Error("Caller does not have access to patient data.")
-	}
-
-	visit.Perscription = params.Perscription
-	t.setVisit(stub, visit)
-
-	result, _ := json.Marshal(visit)
-	return shim.Success(result)
-}
-
-func (t *MedicalRecordChaincode) getMedicalRecords(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	params := PatientIDParams{}
-	caller, _, err := getCallParams(stub, args, params)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	ac := AccessControl{t}
-	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor, []byte(caller))
-	if access != 2 {
-		return shim.Error("Caller does not have access to patient info.")
-	}
-
-	countkey, _ := stub.CreateCompositeKey(VisitInfoCountKey, []string{string(params.PatientID)})
-	count, _ := t.getValue(stub, countkey)
-
-	patient, err := t.getPatient(stub, params.PatientID)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	history := []MedicalVisit{}
-
-	for visitID := uint64(0); visitID < count; visitID++ {
-		visit, _ := t.getVisit(stub, params.PatientID, visitID)
-		history = append(history, visit)
-	}
-
-	records := MedicalRecords{
-		Patient: patient,
-		History: history,
-	}
-	result, _ := json.Marshal(records)
-	return shim.Success(result)
-}
-
-//**************************************************************
-// smart contract private functions
-//**************************************************************
-
-func (t *MedicalRecordChaincode) setPatient(stub shim.ChaincodeStubInterface, patient PatientInfo) error {
-	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{string(patient.PatientID)})
-	result, _ := json.Marshal(patient)
-	return stub.PutState(key, result)
-}
-
-func (t *MedicalRecordChaincode) getPatient(stub shim.ChaincodeStubInterface, id uint64) (PatientInfo, error) {
-	var result PatientInfo
-	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{string(id)})
-	data, err := stub.GetState(key)
-	if err != nil {
-		return result, err
-	}
-	err = json.Unmarshal(data, &result)
-	return result, err
-}
-
-func (t *MedicalRecordChaincode) setVisit(stub shim.ChaincodeStubInterface, visit MedicalVisit) error {
-	key, _ := stub.CreateCompositeKey(MedVisitKey, []string{string(visit.PatientID), string(visit.VisitID)})
-	result, _ := json.Marshal(visit)
-	return stub.PutState(key, result)
-}
-
-func (t *MedicalRecordChaincode) getVisit(stub shim.ChaincodeStubInterface, patientId uint64, id uint64) (MedicalVisit, error) {
-	var result MedicalVisit
-	key, _ := stub.CreateCompositeKey(MedVisitKey, []string{string(patientId), string(id)})
-	data, err := stub.GetState(key)
-	if err != nil {
-		return result, err
-	}
-	err = json.Unmarshal(data, &result)
-	return result, err
-}
-
-func (t *MedicalRecordChaincode) setValue(stub shim.ChaincodeStubInterface, key string, value uint64) error {
-	data := make([]byte, 8)
-	binary.LittleEndian.PutUint64(data, value)
-	return stub.PutState(key, data)
-}
-
-func (t *MedicalRecordChaincode) getValue(stub shim.ChaincodeStubInterface, key string) (uint64, error) {
-	data, err := stub.GetState(key)
-	if err != nil {
-		return 0, err
-	}
-
-	// if the user cn is not in the state, then the balance is 0
-	if data == nil {
-		return 0, nil
-	}
-
-	return binary.LittleEndian.Uint64(data), nil
-}
-
-//**************************************************************
-// Chaincode utils
-//**************************************************************
-func getCallParams(stub shim.ChaincodeStubInterface, args []string, params interface{}) (string, string, error) {
-	if len(args) != 1 {
-		return "", "", errors.New("Transfer expected 1 argument")
-	}
-
-	err := json.Unmarshal([]byte(args[0]), params)
-	if err != nil {
-		return "", "", errors.New("Error parsing transfer json")
-	}
-
-	caller, err := callerCN(stub)
-	if err != nil {
-		return "", "", errors.New("Error getting caller data")
-	}
-
-	owner, err := getOwnerCN(stub)
-	if err != nil {
-		return "", "", errors.New("Error getting owner data")
-	}
-
-	return caller, owner, nil
-}
-
-func getOwnerKey(stub shim.ChaincodeStubInterface) (string, error) {
-	return stub.CreateCompositeKey(MetadataKey, []string{"Owner"})
-}
-
-func getOwnerCN(stub shim.ChaincodeStubInterface) (string, error) {
-	key, _ := getOwnerKey(stub)
-	data, err := stub.GetState(key)
-	return string(data), err
-}
-
-//**************************************************************
-// Utils
-//**************************************************************
-
-//CallerCN extracts caller certificate from calldata
-func callerCN(stub shim.ChaincodeStubInterface) (string, error) {
-	data, _ := stub.GetCreator()
-	serializedID := msp.SerializedIdentity{}
-	err := proto.Unmarshal(data, &serializedID)
-	if err != nil {
-		return "", errors.New("Could not unmarshal Creator")
-	}
-
-	cn, err := cnFromX509(string(serializedID.IdBytes))
-	if err != nil {
-		return "", err
-	}
-	return cn, nil
-}
-
-// extracts CN from an x509 certificate
-func cnFromX509(certPEM string) (string, error) {
-	cert, err := parsePEM(certPEM)
-	if err != nil {
-		return "", errors.New("Failed to parse certificate: " + err.Error())
-	}
-	return cert.Subject.CommonName, nil
-}
-
-func parsePEM(certPEM string) (*x509.Certificate, error) {
-	block, _ := pem.Decode([]byte(certPEM))
-	if block == nil {
-		return nil, errors.New("Failed to parse PEM certificate")
-	}
-
-	return x509.ParseCertificate(block.Bytes)
-}
+package main
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// MetadataKey database key prefix for chaincode metadata such as the owner
+	MetadataKey = "__metadata_"
+	// PatientInfoKey database key prefix for patient information
+	PatientInfoKey = "__patient_record_"
+	// PatientInfoCountKey database key prefix for patient count
+	PatientInfoCountKey = "__patient_count_"
+	// MedVisitKey database key prefix for medical visits
+	MedVisitKey = "__visit_record_"
+	// VisitInfoCountKey database key prefix for visit count
+	VisitInfoCountKey = "__visit_count_"
+)
+
+// main function starts up the chaincode in the container during instantiation
+func main() {
+	if err := shim.Start(new(MedicalRecordChaincode)); err != nil {
+		fmt.Printf("Error starting chaincode: %s", err)
+	}
+}
+
+// MedicalRecordChaincode is the object that contains all of the chaincode that can be executed
+type MedicalRecordChaincode struct {
+}
+
+// Doc type discriminators so CouchDB-backed state databases can run Mango
+// selector queries across patients/visits (see QueryPatients/QueryVisits).
+const (
+	PatientDocType = "patient"
+	VisitDocType   = "visit"
+)
+
+// PatientInfo is a patient's registration record
+type PatientInfo struct {
+	DocType   string `json:"docType"`
+	PatientID uint64 `json:"ID"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Gender    uint64 `json:"gender"` // 0 - Unspecified; 1 - Male; 2 - Female;
+	BirthDate uint64 `json:"birthdate"`
+	Phone     string `json:"phone"`
+}
+
+type MedicalVisit struct {
+	DocType      string `json:"docType"`
+	VisitID      uint64 `json:"ID"`
+	PatientID    uint64 `json:"patient"`
+	Doctor       string `json:"doctor"`
+	Complaint    string `json:"complaint"`
+	Diagnosis    string `json:"diagnosis"`
+	Perscription string `json:"perscription"`
+}
+
+type PatientInfoParams struct {
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Gender    uint64 `json:"gender"`
+	BirthDate uint64 `json:"birthdate"`
+	Phone     string `json:"phone"`
+}
+
+type PatientIDParams struct {
+	PatientID uint64 `json:"ID"`
+	Doctor    string `json:"doctor"`
+}
+
+// VisitInfoParams no longer carries Complaint: PHI text is passed via the
+// transient map (see transientComplaintKey) so it never appears in the
+// transaction proposal payload.
+type VisitInfoParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+}
+
+// DiagnosisParams no longer carries Diagnosis: see VisitInfoParams.
+type DiagnosisParams struct {
+	VisitID   uint64 `json:"ID"`
+	PatientID uint64 `json:"patient"`
+}
+
+// PerscriptionParams no longer carries Perscription: see VisitInfoParams.
+type PerscriptionParams struct {
+	VisitID   uint64 `json:"ID"`
+	PatientID uint64 `json:"patient"`
+}
+
+const (
+	transientComplaintKey    = "complaint"
+	transientDiagnosisKey    = "diagnosis"
+	transientPerscriptionKey = "perscription"
+)
+
+type DoctorParams struct {
+	Doctor string `json:"doctor"`
+}
+
+type SetDoctorAccessParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+	Access    uint64 `json:"access"`
+}
+
+type RequestAccessParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+	Access    uint64 `json:"access"`
+}
+
+type GrantAccessParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+	Access    uint64 `json:"access"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type RevokeAccessParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+}
+
+type ListPendingRequestsParams struct {
+	PatientID uint64 `json:"patient"`
+}
+
+type GetMedicalRecordsPageParams struct {
+	PatientID uint64 `json:"patient"`
+	Doctor    string `json:"doctor"`
+	PageSize  int32  `json:"pageSize"`
+	Bookmark  string `json:"bookmark"`
+}
+
+type MedicalRecordsPage struct {
+	Patient  PatientInfo    `json:"patient"`
+	History  []MedicalVisit `json:"history"`
+	Bookmark string         `json:"bookmark"`
+}
+
+type MedicalRecords struct {
+	Patient PatientInfo    `json:"patient"`
+	History []MedicalVisit `json:"history"`
+}
+
+// Init runs initialization for chaincode
+func (t *MedicalRecordChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	caller, err := callerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+
+	ownerKey, err := getOwnerKey(stub)
+	if err != nil {
+		return shim.Error("Error getting database key")
+	}
+
+	err = stub.PutState(ownerKey, []byte(caller))
+	if err != nil {
+		return shim.Error("Error saving data")
+	}
+
+	return shim.Success(nil)
+}
+
+// invokeHandler is a typed invoke entry point: the stub plus the single JSON
+// argument clients pass, decoded by the handler into its own params struct.
+// Each handler is responsible for enforcing whatever patient-level access it
+// needs (via AccessControl.checkAccess) since the patient ID lives in its own
+// params struct and the required level in its own body, not in any data
+// Invoke has access to.
+type invokeHandler struct {
+	fn func(t *MedicalRecordChaincode, stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response
+}
+
+// invokeRegistry replaces the old untyped switch in Invoke: every callable
+// function and its handler are declared in one place instead of being
+// implicit in a growing switch statement.
+var invokeRegistry = map[string]invokeHandler{
+	"RegisterPatient":          {fn: (*MedicalRecordChaincode).registerPatient},
+	"UpdatePatientDetails":     {fn: (*MedicalRecordChaincode).updatePatient},
+	"GetPatient":               {fn: (*MedicalRecordChaincode).getPatientById},
+	"PatientVisit":             {fn: (*MedicalRecordChaincode).patientVisit},
+	"SetDiagnosis":             {fn: (*MedicalRecordChaincode).setDiagnosis},
+	"SetPerscription":          {fn: (*MedicalRecordChaincode).setPerscription},
+	"GetMedicalRecords":        {fn: (*MedicalRecordChaincode).getMedicalRecords},
+	"RegisterDoctor":           {fn: (*MedicalRecordChaincode).registerDoctor},
+	"SetDoctorAccess":          {fn: (*MedicalRecordChaincode).setDocAccess},
+	"RequestAccess":            {fn: (*MedicalRecordChaincode).requestAccess},
+	"GrantAccess":              {fn: (*MedicalRecordChaincode).grantAccess},
+	"RevokeAccess":             {fn: (*MedicalRecordChaincode).revokeAccess},
+	"ListPendingRequests":      {fn: (*MedicalRecordChaincode).listPendingRequests},
+	"GetAuditTrail":            {fn: (*MedicalRecordChaincode).getAuditTrailInvoke},
+	"GetMedicalRecordsPage":    {fn: (*MedicalRecordChaincode).getMedicalRecordsPage},
+	"QueryPatients":            {fn: (*MedicalRecordChaincode).queryPatients},
+	"QueryVisits":              {fn: (*MedicalRecordChaincode).queryVisits},
+	"GetPrivateMedicalRecords": {fn: (*MedicalRecordChaincode).getPrivateMedicalRecords},
+	"IssuePrescription":        {fn: (*MedicalRecordChaincode).issuePrescription},
+	"EndorsePrescription":      {fn: (*MedicalRecordChaincode).endorsePrescription},
+	"DispensePrescription":     {fn: (*MedicalRecordChaincode).dispensePrescription},
+	"GetPrescription":          {fn: (*MedicalRecordChaincode).getPrescriptionInvoke},
+	"ListPrescriptionsByState": {fn: (*MedicalRecordChaincode).listPrescriptionsByState},
+}
+
+// Invoke runs functions of chaincode, dispatching through invokeRegistry
+// instead of a switch; each handler decodes the single argument into its
+// own params struct.
+func (t *MedicalRecordChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	fn, args := stub.GetFunctionAndParameters()
+
+	handler, ok := invokeRegistry[fn]
+	if !ok {
+		return shim.Error("Undefined function")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Expected exactly 1 argument")
+	}
+
+	return handler.fn(t, stub, json.RawMessage(args[0]))
+}
+
+func (t *MedicalRecordChaincode) registerPatient(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PatientInfoParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	count, _ := t.getValue(stub, PatientInfoCountKey)
+
+	var newPatient = PatientInfo{
+		PatientID: count + 1,
+		FirstName: params.FirstName,
+		LastName:  params.LastName,
+		Gender:    params.Gender,
+		BirthDate: params.BirthDate,
+		Phone:     params.Phone,
+	}
+
+	collection, err := collectionForCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := t.setPatientCollection(stub, newPatient.PatientID, collection); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	t.setPatient(stub, newPatient, collection)
+	t.setValue(stub, PatientInfoCountKey, count+1)
+
+	ac := AccessControl{t}
+	ac.setPatientCN(stub, newPatient.PatientID, caller)
+
+	result, _ := json.Marshal(newPatient)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) requestAccess(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := RequestAccessParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	_, err = ac.requestAccess(stub, params.PatientID, params.Doctor, AccessType(params.Access))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) grantAccess(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := GrantAccessParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	_, err = ac.grantAccess(stub, params.PatientID, params.Doctor, AccessType(params.Access), params.ExpiresAt, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) revokeAccess(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := RevokeAccessParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	_, err = ac.revokeAccess(stub, params.PatientID, params.Doctor, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) listPendingRequests(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := ListPendingRequestsParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	requests, err := ac.listPendingRequests(stub, params.PatientID, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(requests)
+	return shim.Success(result)
+}
+
+// getPrivateMedicalRecords is the Private Data Collection counterpart of
+// GetMedicalRecords: it fetches PHI straight from the collection and checks
+// every record against its public SHA-256 commitment before returning it,
+// so a caller never trusts unverified private data. Access is enforced
+// exactly as for GetMedicalRecords.
+func (t *MedicalRecordChaincode) getPrivateMedicalRecords(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PatientIDParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor)
+	if access != 2 {
+		recordAudit(stub, params.PatientID, "GetPrivateMedicalRecords", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient info.")
+	}
+
+	patient, err := t.getVerifiedPatient(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetPrivateMedicalRecords", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+
+	history, err := t.getVerifiedVisits(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetPrivateMedicalRecords", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+	recordAudit(stub, params.PatientID, "GetPrivateMedicalRecords", caller, raw, access, "success")
+
+	records := MedicalRecords{
+		Patient: patient,
+		History: history,
+	}
+	result, _ := json.Marshal(records)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) getAuditTrailInvoke(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := GetAuditTrailParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entries, err := t.getAuditTrail(stub, params.PatientID, caller, params.UseHistory)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(entries)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) setDocAccess(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := SetDoctorAccessParams{}
+	caller, owner, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if caller != owner {
+		err = errors.New("Only the chaincode owner may set doctor access directly")
+	} else {
+		ac := AccessControl{t}
+		_, err = ac.setAccess(stub, params.PatientID, params.Doctor, AccessType(params.Access))
+	}
+
+	outcome := "success"
+	if err != nil {
+		outcome = "denied"
+	}
+	recordAudit(stub, params.PatientID, "SetDoctorAccess", caller, raw, AccessType(params.Access), outcome)
+
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) registerDoctor(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := DoctorParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	_, err = ac.registerDoctor(stub, params.Doctor)
+
+	outcome := "success"
+	if err != nil {
+		outcome = "denied"
+	}
+	// RegisterDoctor has no single patient in scope, so it is audited under
+	// patient 0.
+	recordAudit(stub, 0, "RegisterDoctor", caller, raw, None, outcome)
+
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) updatePatient(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PatientInfo{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.getPatient(stub, params.PatientID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	collection, err := t.getPatientCollection(stub, params.PatientID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t.setPatient(stub, params, collection)
+	return shim.Success(nil)
+}
+
+func (t *MedicalRecordChaincode) getPatientById(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PatientIDParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor)
+	if access == 0 {
+		recordAudit(stub, params.PatientID, "GetPatient", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient info.")
+	}
+
+	patient, err := t.getPatient(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetPatient", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+	recordAudit(stub, params.PatientID, "GetPatient", caller, raw, access, "success")
+	result, _ := json.Marshal(patient)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) patientVisit(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := VisitInfoParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	complaint, ok := transient[transientComplaintKey]
+	if !ok {
+		return shim.Error("Missing \"complaint\" in transient map")
+	}
+
+	countkey, _ := stub.CreateCompositeKey(VisitInfoCountKey, []string{strconv.FormatUint(params.PatientID, 10)})
+	count, _ := t.getValue(stub, countkey)
+
+	var newVisit = MedicalVisit{
+		VisitID:   count + 1,
+		PatientID: params.PatientID,
+		Doctor:    params.Doctor,
+		Complaint: string(complaint),
+	}
+	collection, err := t.getPatientCollection(stub, params.PatientID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t.setVisit(stub, newVisit, collection)
+	t.setValue(stub, countkey, count+1)
+
+	result, _ := json.Marshal(newVisit)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) setDiagnosis(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := DiagnosisParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	diagnosis, ok := transient[transientDiagnosisKey]
+	if !ok {
+		return shim.Error("Missing \"diagnosis\" in transient map")
+	}
+
+	visit, _ := t.getVisit(stub, params.PatientID, params.VisitID)
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, visit.Doctor)
+	if access != 2 {
+		recordAudit(stub, params.PatientID, "SetDiagnosis", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient data.")
+	}
+
+	collection, err := t.getPatientCollection(stub, params.PatientID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visit.Diagnosis = string(diagnosis)
+	t.setVisit(stub, visit, collection)
+	recordAudit(stub, params.PatientID, "SetDiagnosis", caller, raw, access, "success")
+
+	result, _ := json.Marshal(visit)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) setPerscription(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PerscriptionParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	perscription, ok := transient[transientPerscriptionKey]
+	if !ok {
+		return shim.Error("Missing \"perscription\" in transient map")
+	}
+
+	visit, _ := t.getVisit(stub, params.PatientID, params.VisitID)
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, visit.Doctor)
+	if access != 2 {
+		recordAudit(stub, params.PatientID, "SetPerscription", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient data.")
+	}
+
+	collection, err := t.getPatientCollection(stub, params.PatientID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visit.Perscription = string(perscription)
+	t.setVisit(stub, visit, collection)
+	recordAudit(stub, params.PatientID, "SetPerscription", caller, raw, access, "success")
+
+	result, _ := json.Marshal(visit)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) getMedicalRecords(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PatientIDParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor)
+	if access != 2 {
+		recordAudit(stub, params.PatientID, "GetMedicalRecords", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient info.")
+	}
+	patient, err := t.getPatient(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetMedicalRecords", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+
+	history, err := t.listVisits(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetMedicalRecords", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+	recordAudit(stub, params.PatientID, "GetMedicalRecords", caller, raw, access, "success")
+
+	records := MedicalRecords{
+		Patient: patient,
+		History: history,
+	}
+	result, _ := json.Marshal(records)
+	return shim.Success(result)
+}
+
+// getMedicalRecordsPage is the paginated sibling of getMedicalRecords, for
+// patients with long histories. It walks the same MedVisitKey composite-key
+// space a page at a time and hands back a bookmark to resume from.
+func (t *MedicalRecordChaincode) getMedicalRecordsPage(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := GetMedicalRecordsPageParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ac := AccessControl{t}
+	access, _ := ac.checkAccess(stub, params.PatientID, params.Doctor)
+	if access != 2 {
+		recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "denied")
+		return shim.Error("Caller does not have access to patient info.")
+	}
+
+	patient, err := t.getVerifiedPatient(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+
+	collection, err := t.getPatientCollection(stub, params.PatientID)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+
+	// Pagination walks the public commitment keys; the pages are small
+	// enough that fetching the matching private record per key is fine.
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(MedVisitKey, []string{strconv.FormatUint(params.PatientID, 10)}, params.PageSize, params.Bookmark)
+	if err != nil {
+		recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+		return shim.Error(err.Error())
+	}
+	defer iterator.Close()
+
+	history := []MedicalVisit{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+			return shim.Error(err.Error())
+		}
+
+		data, err := stub.GetPrivateData(collection, item.Key)
+		if err != nil {
+			recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+			return shim.Error(err.Error())
+		}
+		if string(hashJSON(data)) != string(item.Value) {
+			recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+			return shim.Error("Private visit data does not match the public commitment")
+		}
+
+		var visit MedicalVisit
+		if err := json.Unmarshal(data, &visit); err != nil {
+			recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "error")
+			return shim.Error(err.Error())
+		}
+		history = append(history, visit)
+	}
+	recordAudit(stub, params.PatientID, "GetMedicalRecordsPage", caller, raw, access, "success")
+
+	page := MedicalRecordsPage{
+		Patient:  patient,
+		History:  history,
+		Bookmark: metadata.GetBookmark(),
+	}
+	result, _ := json.Marshal(page)
+	return shim.Success(result)
+}
+
+//**************************************************************
+// smart contract private functions
+//**************************************************************
+
+// setPatient writes only a SHA-256 commitment of the patient's PHI to the
+// public ledger under the usual composite key, and the full record to the
+// patient's own organization's Private Data Collection. collection is
+// resolved by the caller rather than re-read from state here, since a peer
+// does not surface a PutState from earlier in the same transaction (e.g.
+// registerPatient's own setPatientCollection) to a later GetState.
+func (t *MedicalRecordChaincode) setPatient(stub shim.ChaincodeStubInterface, patient PatientInfo, collection string) error {
+	patient.DocType = PatientDocType
+	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{strconv.FormatUint(patient.PatientID, 10)})
+	result, err := json.Marshal(patient)
+	if err != nil {
+		return err
+	}
+
+	if err := stub.PutState(key, hashJSON(result)); err != nil {
+		return err
+	}
+
+	return stub.PutPrivateData(collection, key, result)
+}
+
+// getPatient reads a patient's PHI from its Private Data Collection.
+func (t *MedicalRecordChaincode) getPatient(stub shim.ChaincodeStubInterface, id uint64) (PatientInfo, error) {
+	var result PatientInfo
+
+	collection, err := t.getPatientCollection(stub, id)
+	if err != nil {
+		return result, err
+	}
+
+	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{strconv.FormatUint(id, 10)})
+	data, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// setVisit writes only a SHA-256 commitment of the visit's PHI to the public
+// ledger, and the full record to the patient's Private Data Collection.
+// collection is resolved by the caller; see setPatient for why.
+func (t *MedicalRecordChaincode) setVisit(stub shim.ChaincodeStubInterface, visit MedicalVisit, collection string) error {
+	visit.DocType = VisitDocType
+	key, _ := stub.CreateCompositeKey(MedVisitKey, []string{strconv.FormatUint(visit.PatientID, 10), strconv.FormatUint(visit.VisitID, 10)})
+	result, err := json.Marshal(visit)
+	if err != nil {
+		return err
+	}
+
+	if err := stub.PutState(key, hashJSON(result)); err != nil {
+		return err
+	}
+
+	return stub.PutPrivateData(collection, key, result)
+}
+
+// getVisit reads a visit's PHI from the owning patient's Private Data
+// Collection.
+func (t *MedicalRecordChaincode) getVisit(stub shim.ChaincodeStubInterface, patientId uint64, id uint64) (MedicalVisit, error) {
+	var result MedicalVisit
+
+	collection, err := t.getPatientCollection(stub, patientId)
+	if err != nil {
+		return result, err
+	}
+
+	key, _ := stub.CreateCompositeKey(MedVisitKey, []string{strconv.FormatUint(patientId, 10), strconv.FormatUint(id, 10)})
+	data, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// listVisits walks every visit recorded for a patient via partial composite
+// key iteration over its Private Data Collection, instead of counting up to
+// a maintained VisitInfoCountKey, so it keeps working correctly if a visit
+// is ever deleted.
+func (t *MedicalRecordChaincode) listVisits(stub shim.ChaincodeStubInterface, patientId uint64) ([]MedicalVisit, error) {
+	collection, err := t.getPatientCollection(stub, patientId)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, MedVisitKey, []string{strconv.FormatUint(patientId, 10)})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	history := []MedicalVisit{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var visit MedicalVisit
+		if err := json.Unmarshal(item.Value, &visit); err != nil {
+			return nil, err
+		}
+		history = append(history, visit)
+	}
+
+	return history, nil
+}
+
+func (t *MedicalRecordChaincode) setValue(stub shim.ChaincodeStubInterface, key string, value uint64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return stub.PutState(key, data)
+}
+
+func (t *MedicalRecordChaincode) getValue(stub shim.ChaincodeStubInterface, key string) (uint64, error) {
+	data, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// if the key is not in the state, then the value is 0
+	if data == nil {
+		return 0, nil
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// **************************************************************
+// Chaincode utils
+// **************************************************************
+func getCallParams(stub shim.ChaincodeStubInterface, raw json.RawMessage, params interface{}) (string, string, error) {
+	if err := json.Unmarshal(raw, params); err != nil {
+		return "", "", errors.New("Error parsing invoke payload")
+	}
+
+	caller, err := callerCN(stub)
+	if err != nil {
+		return "", "", errors.New("Error getting caller data")
+	}
+
+	owner, err := getOwnerCN(stub)
+	if err != nil {
+		return "", "", errors.New("Error getting owner data")
+	}
+
+	return caller, owner, nil
+}
+
+func getOwnerKey(stub shim.ChaincodeStubInterface) (string, error) {
+	return stub.CreateCompositeKey(MetadataKey, []string{"Owner"})
+}
+
+func getOwnerCN(stub shim.ChaincodeStubInterface) (string, error) {
+	key, _ := getOwnerKey(stub)
+	data, err := stub.GetState(key)
+	return string(data), err
+}
+
+//**************************************************************
+// Utils
+//**************************************************************
+
+// callerCN extracts the CN of the caller's certificate from calldata
+func callerCN(stub shim.ChaincodeStubInterface) (string, error) {
+	data, _ := stub.GetCreator()
+	serializedID := msp.SerializedIdentity{}
+	err := proto.Unmarshal(data, &serializedID)
+	if err != nil {
+		return "", errors.New("Could not unmarshal Creator")
+	}
+
+	cn, err := cnFromX509(string(serializedID.IdBytes))
+	if err != nil {
+		return "", err
+	}
+	return cn, nil
+}
+
+// extracts CN from an x509 certificate
+func cnFromX509(certPEM string) (string, error) {
+	cert, err := parsePEM(certPEM)
+	if err != nil {
+		return "", errors.New("Failed to parse certificate: " + err.Error())
+	}
+	return cert.Subject.CommonName, nil
+}
+
+func parsePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("Failed to parse PEM certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/shimtest"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// fabricAttrsOID is the X.509 extension Fabric CA uses to assert ABAC
+// attributes (role, specialty, hospital, ...) on an enrollment certificate.
+var fabricAttrsOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+type fabricAttrs struct {
+	Attrs map[string]string `json:"attrs"`
+}
+
+var txCounter int
+
+// nextTxID hands out a unique MockStub transaction id per call.
+func nextTxID() string {
+	txCounter++
+	return fmt.Sprintf("tx-%d", txCounter)
+}
+
+// mockCreator builds the serialized creator identity bytes a MockStub caller
+// presents, backed by a self-signed certificate asserting cn and any ABAC
+// attributes Fabric CA would otherwise assert at enrollment.
+func mockCreator(t *testing.T, mspID string, cn string, attrs map[string]string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+	}
+
+	if len(attrs) > 0 {
+		raw, err := json.Marshal(fabricAttrs{Attrs: attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: fabricAttrsOID, Value: raw})
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	serialized, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serialized
+}
+
+// newInitializedStub spins up a MockStub for MedicalRecordChaincode, setting
+// ownerCreator as the chaincode owner captured by Init.
+func newInitializedStub(t *testing.T, ownerCreator []byte) *shimtest.MockStub {
+	t.Helper()
+
+	stub := shimtest.NewMockStub("medrecord", new(MedicalRecordChaincode))
+	stub.Creator = ownerCreator
+
+	txID := nextTxID()
+	stub.MockTransactionStart(txID)
+	resp := stub.MockInit(txID, nil)
+	stub.MockTransactionEnd(txID)
+	if resp.Status != shim.OK {
+		t.Fatalf("Init failed: %s", resp.Message)
+	}
+	return stub
+}
+
+// invoke runs fn as creator with payload JSON-encoded as the single invoke
+// argument, optionally seeding the transient map beforehand.
+func invoke(t *testing.T, stub *shimtest.MockStub, creator []byte, transient map[string][]byte, fn string, payload interface{}) peer.Response {
+	t.Helper()
+
+	stub.Creator = creator
+	stub.TransientMap = transient
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txID := nextTxID()
+	stub.MockTransactionStart(txID)
+	resp := stub.MockInvoke(txID, [][]byte{[]byte(fn), raw})
+	stub.MockTransactionEnd(txID)
+	return resp
+}
+
+// TestMockStubSupportsRequiredFeatures isolates the two MockStub behaviors
+// TestPatientVisitAccessGrantFlow quietly depends on (GetTxTimestamp, used by
+// checkAccess/recordAudit/requestAccess, and GetPrivateDataByPartialCompositeKey,
+// used by listVisits): shimtest's support for both has varied across Fabric
+// releases. If a vendored Fabric bump drops either, this fails here with a
+// pointed message instead of surfacing as a confusing failure deep in the
+// end-to-end flow.
+func TestMockStubSupportsRequiredFeatures(t *testing.T) {
+	owner := mockCreator(t, "OwnerMSP", "owner-cn", nil)
+	stub := newInitializedStub(t, owner)
+
+	txID := nextTxID()
+	stub.MockTransactionStart(txID)
+	if _, err := stub.GetTxTimestamp(); err != nil {
+		t.Fatalf("MockStub.GetTxTimestamp is unsupported: %v", err)
+	}
+	stub.MockTransactionEnd(txID)
+
+	const collection = "patientData_Org1MSP"
+	key, err := stub.CreateCompositeKey(MedVisitKey, []string{"1", "1"})
+	if err != nil {
+		t.Fatalf("CreateCompositeKey: %v", err)
+	}
+
+	txID = nextTxID()
+	stub.MockTransactionStart(txID)
+	if err := stub.PutPrivateData(collection, key, []byte("{}")); err != nil {
+		t.Fatalf("PutPrivateData: %v", err)
+	}
+	stub.MockTransactionEnd(txID)
+
+	txID = nextTxID()
+	stub.MockTransactionStart(txID)
+	iterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, MedVisitKey, []string{"1"})
+	if err != nil {
+		t.Fatalf("MockStub.GetPrivateDataByPartialCompositeKey is unsupported: %v", err)
+	}
+	defer iterator.Close()
+	if !iterator.HasNext() {
+		t.Fatal("expected GetPrivateDataByPartialCompositeKey to find the seeded visit")
+	}
+	stub.MockTransactionEnd(txID)
+}
+
+// TestPatientVisitAccessGrantFlow exercises the consent-gated path a doctor
+// and patient walk through end to end: registration, a doctor requesting and
+// being granted access, recording a visit and diagnosis, reading the
+// resulting medical record, and losing access again on revoke.
+func TestPatientVisitAccessGrantFlow(t *testing.T) {
+	owner := mockCreator(t, "OwnerMSP", "owner-cn", nil)
+	patient := mockCreator(t, "Org1MSP", "alice", nil)
+	doctor := mockCreator(t, "Org1MSP", "dr-house", map[string]string{"role": "doctor"})
+
+	stub := newInitializedStub(t, owner)
+
+	resp := invoke(t, stub, patient, nil, "RegisterPatient", PatientInfoParams{
+		FirstName: "Alice",
+		LastName:  "Anderson",
+		Gender:    2,
+		BirthDate: 19900101,
+		Phone:     "555-0100",
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("RegisterPatient failed: %s", resp.Message)
+	}
+	var registered PatientInfo
+	if err := json.Unmarshal(resp.Payload, &registered); err != nil {
+		t.Fatalf("decoding RegisterPatient response: %v", err)
+	}
+	if registered.PatientID != 1 {
+		t.Fatalf("expected patient ID 1, got %d", registered.PatientID)
+	}
+	patientID := registered.PatientID
+
+	resp = invoke(t, stub, doctor, nil, "RegisterDoctor", DoctorParams{Doctor: "dr-house"})
+	if resp.Status != shim.OK {
+		t.Fatalf("RegisterDoctor failed: %s", resp.Message)
+	}
+
+	resp = invoke(t, stub, doctor, nil, "RequestAccess", RequestAccessParams{
+		PatientID: patientID,
+		Doctor:    "dr-house",
+		Access:    uint64(Full),
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("RequestAccess failed: %s", resp.Message)
+	}
+
+	resp = invoke(t, stub, patient, nil, "ListPendingRequests", ListPendingRequestsParams{PatientID: patientID})
+	if resp.Status != shim.OK {
+		t.Fatalf("ListPendingRequests failed: %s", resp.Message)
+	}
+	var pending []AccessRequest
+	if err := json.Unmarshal(resp.Payload, &pending); err != nil {
+		t.Fatalf("decoding ListPendingRequests response: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Doctor != "dr-house" {
+		t.Fatalf("expected one pending request for dr-house, got %+v", pending)
+	}
+
+	resp = invoke(t, stub, patient, nil, "GrantAccess", GrantAccessParams{
+		PatientID: patientID,
+		Doctor:    "dr-house",
+		Access:    uint64(Full),
+		ExpiresAt: 0,
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("GrantAccess failed: %s", resp.Message)
+	}
+
+	resp = invoke(t, stub, doctor, map[string][]byte{transientComplaintKey: []byte("persistent headache")}, "PatientVisit", VisitInfoParams{
+		PatientID: patientID,
+		Doctor:    "dr-house",
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("PatientVisit failed: %s", resp.Message)
+	}
+	var visit MedicalVisit
+	if err := json.Unmarshal(resp.Payload, &visit); err != nil {
+		t.Fatalf("decoding PatientVisit response: %v", err)
+	}
+	if visit.VisitID != 1 {
+		t.Fatalf("expected visit ID 1, got %d", visit.VisitID)
+	}
+
+	resp = invoke(t, stub, doctor, map[string][]byte{transientDiagnosisKey: []byte("seasonal flu")}, "SetDiagnosis", DiagnosisParams{
+		VisitID:   visit.VisitID,
+		PatientID: patientID,
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("SetDiagnosis failed: %s", resp.Message)
+	}
+
+	resp = invoke(t, stub, doctor, nil, "GetMedicalRecords", PatientIDParams{PatientID: patientID, Doctor: "dr-house"})
+	if resp.Status != shim.OK {
+		t.Fatalf("GetMedicalRecords failed: %s", resp.Message)
+	}
+	var records MedicalRecords
+	if err := json.Unmarshal(resp.Payload, &records); err != nil {
+		t.Fatalf("decoding GetMedicalRecords response: %v", err)
+	}
+	if len(records.History) != 1 || records.History[0].Diagnosis != "seasonal flu" {
+		t.Fatalf("expected one visit diagnosed with seasonal flu, got %+v", records.History)
+	}
+
+	resp = invoke(t, stub, patient, nil, "RevokeAccess", RevokeAccessParams{PatientID: patientID, Doctor: "dr-house"})
+	if resp.Status != shim.OK {
+		t.Fatalf("RevokeAccess failed: %s", resp.Message)
+	}
+
+	resp = invoke(t, stub, doctor, nil, "GetMedicalRecords", PatientIDParams{PatientID: patientID, Doctor: "dr-house"})
+	if resp.Status == shim.OK {
+		t.Fatal("expected GetMedicalRecords to fail after access was revoked")
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// PrescriptionKey database key prefix for prescription assets
+	PrescriptionKey = "__prescription_"
+	// PrescriptionCountKey database key prefix for prescription ID allocation
+	PrescriptionCountKey = "__prescription_count_"
+	// PrescriptionStateIndexKey indexes prescriptions as state~prescriptionID
+	PrescriptionStateIndexKey = "__prescription_state_"
+	// PrescriptionPatientIndexKey indexes prescriptions as patient~prescriptionID
+	PrescriptionPatientIndexKey = "__prescription_patient_"
+	// PrescriptionDoctorIndexKey indexes prescriptions as doctor~prescriptionID
+	PrescriptionDoctorIndexKey = "__prescription_doctor_"
+	// PrescriptionEventName is the chaincode event emitted on every state transition
+	PrescriptionEventName = "PrescriptionTransition"
+)
+
+// PrescriptionState is a step in a prescription's lifecycle.
+type PrescriptionState string
+
+const (
+	NewPublish       PrescriptionState = "NewPublish"
+	EndorserWaitSign PrescriptionState = "EndorserWaitSign"
+	EndorserSigned   PrescriptionState = "EndorserSigned"
+	Dispensed        PrescriptionState = "Dispensed"
+	Expired          PrescriptionState = "Expired"
+)
+
+// Prescription is a first-class asset tracking a medication order from
+// issuance through endorsement to dispensing, independent of the free-text
+// Perscription field still kept on MedicalVisit for backwards compatibility.
+type Prescription struct {
+	PrescriptionID uint64            `json:"ID"`
+	PatientID      uint64            `json:"patient"`
+	VisitID        uint64            `json:"visit"`
+	Doctor         string            `json:"doctor"`
+	Endorser       string            `json:"endorser"`
+	Pharmacist     string            `json:"pharmacist,omitempty"`
+	Medication     string            `json:"medication"`
+	State          PrescriptionState `json:"state"`
+	IssuedAt       int64             `json:"issuedAt"`
+	ExpiresAt      int64             `json:"expiresAt"`
+}
+
+type IssuePrescriptionParams struct {
+	PatientID  uint64 `json:"patient"`
+	VisitID    uint64 `json:"visit"`
+	Doctor     string `json:"doctor"`
+	Endorser   string `json:"endorser"`
+	Medication string `json:"medication"`
+	ExpiresAt  int64  `json:"expiresAt"`
+}
+
+type EndorsePrescriptionParams struct {
+	PrescriptionID uint64 `json:"ID"`
+	Endorser       string `json:"endorser"`
+}
+
+type DispensePrescriptionParams struct {
+	PrescriptionID uint64 `json:"ID"`
+	Pharmacist     string `json:"pharmacist"`
+}
+
+type PrescriptionIDParams struct {
+	PrescriptionID uint64 `json:"ID"`
+}
+
+type ListPrescriptionsByStateParams struct {
+	State PrescriptionState `json:"state"`
+}
+
+// issuePrescription lets a registered doctor publish a new prescription
+// naming the endorsing doctor, moving it straight from NewPublish into
+// EndorserWaitSign since the endorser is already known at issuance time.
+func (t *MedicalRecordChaincode) issuePrescription(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := IssuePrescriptionParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := verifyDoctor(stub, params.Doctor); err != nil {
+		return shim.Error(err.Error())
+	}
+	if params.Endorser == params.Doctor {
+		return shim.Error("A doctor may not endorse their own prescription")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	count, _ := t.getValue(stub, PrescriptionCountKey)
+	prescription := Prescription{
+		PrescriptionID: count + 1,
+		PatientID:      params.PatientID,
+		VisitID:        params.VisitID,
+		Doctor:         params.Doctor,
+		Endorser:       params.Endorser,
+		Medication:     params.Medication,
+		State:          NewPublish,
+		IssuedAt:       txTimestamp.Seconds,
+		ExpiresAt:      params.ExpiresAt,
+	}
+
+	if err := t.putPrescription(stub, prescription); err != nil {
+		return shim.Error(err.Error())
+	}
+	t.setValue(stub, PrescriptionCountKey, count+1)
+
+	if err := t.transitionPrescription(stub, &prescription, EndorserWaitSign); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(prescription)
+	return shim.Success(result)
+}
+
+// endorsePrescription lets the named second doctor sign off on a
+// prescription that's waiting on them.
+func (t *MedicalRecordChaincode) endorsePrescription(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := EndorsePrescriptionParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := verifyDoctor(stub, params.Endorser); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	prescription, err := t.getPrescription(stub, params.PrescriptionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if prescription.Endorser != params.Endorser {
+		return shim.Error("Caller is not the named endorser for this prescription")
+	}
+	if prescription.State != EndorserWaitSign {
+		return shim.Error("Prescription is not awaiting endorsement")
+	}
+
+	if err := t.transitionPrescription(stub, &prescription, EndorserSigned); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(prescription)
+	return shim.Success(result)
+}
+
+// dispensePrescription lets a pharmacist fulfil a signed prescription,
+// deterministically rejecting it once its ExpiresAt has passed the
+// transaction's ledger timestamp.
+func (t *MedicalRecordChaincode) dispensePrescription(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := DispensePrescriptionParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := verifyPharmacist(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	prescription, err := t.getPrescription(stub, params.PrescriptionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if prescription.State != EndorserSigned {
+		return shim.Error("Prescription is not ready to dispense")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if prescription.ExpiresAt != 0 && prescription.ExpiresAt < txTimestamp.Seconds {
+		// Reject only, and don't transition to Expired: an error response's
+		// write set is never submitted by the client, so that mutation would
+		// never actually persist. An expired prescription therefore stays in
+		// EndorserSigned; callers can tell it apart from one that can still
+		// be dispensed by comparing ExpiresAt themselves.
+		return shim.Error("Prescription has expired")
+	}
+
+	prescription.Pharmacist = params.Pharmacist
+	if err := t.transitionPrescription(stub, &prescription, Dispensed); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(prescription)
+	return shim.Success(result)
+}
+
+func (t *MedicalRecordChaincode) getPrescriptionInvoke(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := PrescriptionIDParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	prescription, err := t.getPrescription(stub, params.PrescriptionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, _ := json.Marshal(prescription)
+	return shim.Success(result)
+}
+
+// listPrescriptionsByState lets off-chain clients list every prescription
+// currently sitting in a given lifecycle state via the state~prescriptionID
+// composite-key index.
+func (t *MedicalRecordChaincode) listPrescriptionsByState(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := ListPrescriptionsByStateParams{}
+	_, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(PrescriptionStateIndexKey, []string{string(params.State)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iterator.Close()
+
+	prescriptions := []Prescription{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, parts, err := stub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var prescriptionID uint64
+		if _, err := fmt.Sscanf(parts[1], "%d", &prescriptionID); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		prescription, err := t.getPrescription(stub, prescriptionID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		prescriptions = append(prescriptions, prescription)
+	}
+
+	result, _ := json.Marshal(prescriptions)
+	return shim.Success(result)
+}
+
+//**************************************************************
+// prescription storage and indexing
+//**************************************************************
+
+func (t *MedicalRecordChaincode) putPrescription(stub shim.ChaincodeStubInterface, prescription Prescription) error {
+	key, err := stub.CreateCompositeKey(PrescriptionKey, []string{strconv.FormatUint(prescription.PrescriptionID, 10)})
+	if err != nil {
+		return err
+	}
+
+	result, err := json.Marshal(prescription)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, result); err != nil {
+		return err
+	}
+
+	patientIndexKey, _ := stub.CreateCompositeKey(PrescriptionPatientIndexKey, []string{strconv.FormatUint(prescription.PatientID, 10), strconv.FormatUint(prescription.PrescriptionID, 10)})
+	if err := stub.PutState(patientIndexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	doctorIndexKey, _ := stub.CreateCompositeKey(PrescriptionDoctorIndexKey, []string{prescription.Doctor, strconv.FormatUint(prescription.PrescriptionID, 10)})
+	if err := stub.PutState(doctorIndexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	stateIndexKey, _ := stub.CreateCompositeKey(PrescriptionStateIndexKey, []string{string(prescription.State), strconv.FormatUint(prescription.PrescriptionID, 10)})
+	return stub.PutState(stateIndexKey, []byte{0x00})
+}
+
+func (t *MedicalRecordChaincode) getPrescription(stub shim.ChaincodeStubInterface, prescriptionID uint64) (Prescription, error) {
+	var result Prescription
+	key, _ := stub.CreateCompositeKey(PrescriptionKey, []string{strconv.FormatUint(prescriptionID, 10)})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return result, err
+	}
+	if data == nil {
+		return result, errors.New("Prescription not found")
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// transitionPrescription moves a prescription to newState, rewriting its
+// state~prescriptionID index entry and emitting a chaincode event so
+// off-chain listeners can track the lifecycle in real time.
+func (t *MedicalRecordChaincode) transitionPrescription(stub shim.ChaincodeStubInterface, prescription *Prescription, newState PrescriptionState) error {
+	oldIndexKey, err := stub.CreateCompositeKey(PrescriptionStateIndexKey, []string{string(prescription.State), strconv.FormatUint(prescription.PrescriptionID, 10)})
+	if err != nil {
+		return err
+	}
+	if prescription.State != "" {
+		if err := stub.DelState(oldIndexKey); err != nil {
+			return err
+		}
+	}
+
+	prescription.State = newState
+
+	key, _ := stub.CreateCompositeKey(PrescriptionKey, []string{strconv.FormatUint(prescription.PrescriptionID, 10)})
+	result, err := json.Marshal(*prescription)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, result); err != nil {
+		return err
+	}
+
+	newIndexKey, _ := stub.CreateCompositeKey(PrescriptionStateIndexKey, []string{string(newState), strconv.FormatUint(prescription.PrescriptionID, 10)})
+	if err := stub.PutState(newIndexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	return stub.SetEvent(PrescriptionEventName, result)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	// CollectionPrefix names the per-organization Private Data Collection that
+	// holds a patient's full PHI payload, e.g. collections_config.json's
+	// "patientData_Org1MSP".
+	CollectionPrefix = "patientData_"
+	// PatientCollectionKey database key prefix recording which collection a
+	// patient's PHI lives in.
+	PatientCollectionKey = "__patient_collection_"
+)
+
+// knownCollections mirrors collections_config.json: the set of per-org
+// Private Data Collections a rich query has to fan out across, since a
+// Mango selector can't reach across collection boundaries in one call.
+var knownCollections = []string{"patientData_Org1MSP", "patientData_Org2MSP"}
+
+// hashJSON fingerprints a JSON payload for the public on-chain commitment
+// that lets any peer verify private data hasn't been tampered with.
+func hashJSON(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// collectionForCaller derives the Private Data Collection a caller's org
+// owns, from their Fabric CA-asserted MSPID.
+func collectionForCaller(stub shim.ChaincodeStubInterface) (string, error) {
+	mspid, err := resolvePrincipal(stub).MSPID()
+	if err != nil {
+		return "", err
+	}
+	return CollectionPrefix + mspid, nil
+}
+
+// setPatientCollection records which collection a patient's PHI was written
+// to, captured once at RegisterPatient time.
+func (t *MedicalRecordChaincode) setPatientCollection(stub shim.ChaincodeStubInterface, patientId uint64, collection string) error {
+	key, _ := stub.CreateCompositeKey(PatientCollectionKey, []string{strconv.FormatUint(patientId, 10)})
+	return stub.PutState(key, []byte(collection))
+}
+
+// getPatientCollection returns the collection a patient's PHI lives in.
+func (t *MedicalRecordChaincode) getPatientCollection(stub shim.ChaincodeStubInterface, patientId uint64) (string, error) {
+	key, _ := stub.CreateCompositeKey(PatientCollectionKey, []string{strconv.FormatUint(patientId, 10)})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if data == nil {
+		return "", errors.New("Patient has no registered private data collection")
+	}
+	return string(data), nil
+}
+
+// getVerifiedPatient fetches a patient's PHI from its Private Data
+// Collection and checks it against the SHA-256 commitment recorded on the
+// public ledger, so a client never trusts private data it can't verify.
+func (t *MedicalRecordChaincode) getVerifiedPatient(stub shim.ChaincodeStubInterface, patientId uint64) (PatientInfo, error) {
+	var result PatientInfo
+
+	collection, err := t.getPatientCollection(stub, patientId)
+	if err != nil {
+		return result, err
+	}
+
+	key, _ := stub.CreateCompositeKey(PatientInfoKey, []string{strconv.FormatUint(patientId, 10)})
+	commitment, err := stub.GetState(key)
+	if err != nil {
+		return result, err
+	}
+
+	data, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return result, err
+	}
+	if data == nil {
+		return result, errors.New("No private data found for patient")
+	}
+
+	if string(hashJSON(data)) != string(commitment) {
+		return result, errors.New("Private patient data does not match the public commitment")
+	}
+
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// getVerifiedVisits fetches every visit recorded for a patient from its
+// Private Data Collection, verifying each one against its public commitment.
+func (t *MedicalRecordChaincode) getVerifiedVisits(stub shim.ChaincodeStubInterface, patientId uint64) ([]MedicalVisit, error) {
+	collection, err := t.getPatientCollection(stub, patientId)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, MedVisitKey, []string{strconv.FormatUint(patientId, 10)})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	history := []MedicalVisit{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		commitment, err := stub.GetState(item.Key)
+		if err != nil {
+			return nil, err
+		}
+		if string(hashJSON(item.Value)) != string(commitment) {
+			return nil, errors.New("Private visit data does not match the public commitment")
+		}
+
+		var visit MedicalVisit
+		if err := json.Unmarshal(item.Value, &visit); err != nil {
+			return nil, err
+		}
+		history = append(history, visit)
+	}
+
+	return history, nil
+}
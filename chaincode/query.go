@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// QueryParams carries a Mango-style CouchDB selector, e.g.
+// `{"selector":{"docType":"visit","doctor":"dr-house"}}`.
+type QueryParams struct {
+	Selector string `json:"selector"`
+}
+
+// queryPatients runs a rich CouchDB query over patient documents, filtering
+// on fields such as name or birth date range. Patient PHI lives in private
+// data collections since chunk0-5, so the selector is fanned out across
+// every known collection rather than run once over public state. Requires a
+// CouchDB state database; this is not available against LevelDB peers.
+func (t *MedicalRecordChaincode) queryPatients(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := QueryParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner, err := getOwnerCN(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner != caller {
+		return shim.Error("Caller may not run patient queries.")
+	}
+
+	patients := []PatientInfo{}
+	for _, collection := range knownCollections {
+		iterator, err := stub.GetPrivateDataQueryResult(collection, params.Selector)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		for iterator.HasNext() {
+			item, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return shim.Error(err.Error())
+			}
+
+			var patient PatientInfo
+			if err := json.Unmarshal(item.Value, &patient); err != nil {
+				iterator.Close()
+				return shim.Error(err.Error())
+			}
+			patients = append(patients, patient)
+		}
+		iterator.Close()
+	}
+
+	result, _ := json.Marshal(patients)
+	return shim.Success(result)
+}
+
+// queryVisits runs a rich CouchDB query over visit documents, filtering on
+// fields such as doctor or a diagnosis substring. MedicalVisit records no
+// date, so visits cannot be filtered by date range. Like
+// queryPatients, it fans the selector out across every known Private Data
+// Collection.
+func (t *MedicalRecordChaincode) queryVisits(stub shim.ChaincodeStubInterface, raw json.RawMessage) peer.Response {
+	params := QueryParams{}
+	caller, _, err := getCallParams(stub, raw, &params)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner, err := getOwnerCN(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner != caller {
+		return shim.Error("Caller may not run visit queries.")
+	}
+
+	visits := []MedicalVisit{}
+	for _, collection := range knownCollections {
+		iterator, err := stub.GetPrivateDataQueryResult(collection, params.Selector)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		for iterator.HasNext() {
+			item, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return shim.Error(err.Error())
+			}
+
+			var visit MedicalVisit
+			if err := json.Unmarshal(item.Value, &visit); err != nil {
+				iterator.Close()
+				return shim.Error(err.Error())
+			}
+			visits = append(visits, visit)
+		}
+		iterator.Close()
+	}
+
+	result, _ := json.Marshal(visits)
+	return shim.Success(result)
+}